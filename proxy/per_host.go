@@ -5,8 +5,12 @@
 package proxy
 
 import (
+	"errors"
 	"net"
+	"strconv"
 	"strings"
+
+	"golang.org/x/net/idna"
 )
 
 // A PerHost directs connections to a default Dialer unless the hostname
@@ -14,10 +18,18 @@ import (
 type PerHost struct {
 	def, bypass Dialer
 
+	bypassAll      bool
 	bypassNetworks []*net.IPNet
 	bypassIPs      []net.IP
-	bypassZones    []string
-	bypassHosts    []string
+	bypassZonedIPs map[string]bool
+
+	// bypassZones, bypassSubdomains and bypassHosts are sets so that
+	// lookups stay cheap for long bypass lists. Zones are stored with a
+	// leading dot. bypassSubdomains holds zones that, unlike bypassZones,
+	// do not match their apex.
+	bypassZones      map[string]bool
+	bypassSubdomains map[string]bool
+	bypassHosts      map[string]bool
 }
 
 // NewPerHost returns a PerHost Dialer that directs connections to either
@@ -42,7 +54,14 @@ func (p *PerHost) Dial(network, addr string) (c net.Conn, err error) {
 }
 
 func (p *PerHost) dialerForRequest(host string) Dialer {
-	if ip := net.ParseIP(host); ip != nil {
+	if p.bypassAll {
+		return p.bypass
+	}
+	addr, zone := splitZone(host)
+	if ip := parseHostIP(addr); ip != nil {
+		if zone != "" && p.bypassZonedIPs[ip.String()+"%"+zone] {
+			return p.bypass
+		}
 		for _, net := range p.bypassNetworks {
 			if net.Contains(ip) {
 				return p.bypass
@@ -56,18 +75,16 @@ func (p *PerHost) dialerForRequest(host string) Dialer {
 		return p.def
 	}
 
-	for _, zone := range p.bypassZones {
-		if strings.HasSuffix(host, zone) {
-			return p.bypass
-		}
-		if host == zone[1:] {
-			// For a zone "example.com", we match "example.com"
-			// too.
-			return p.bypass
-		}
+	host = normalizeHost(host)
+	if p.bypassHosts[host] {
+		return p.bypass
 	}
-	for _, bypassHost := range p.bypassHosts {
-		if bypassHost == host {
+	// For a zone "example.com", we match "example.com" too.
+	if p.bypassZones["."+host] {
+		return p.bypass
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] == '.' && (p.bypassZones[host[i:]] || p.bypassSubdomains[host[i:]]) {
 			return p.bypass
 		}
 	}
@@ -76,9 +93,20 @@ func (p *PerHost) dialerForRequest(host string) Dialer {
 
 // AddFromString parses a string that contains comma-separated values
 // specifying hosts that should use the bypass proxy. Each value is either an
-// IP address, a CIDR range, a zone (*.example.com) or a hostname
-// (localhost). A best effort is made to parse the string and errors are
-// ignored.
+// IP address, a CIDR range (10.0.0.0/8, or with a dotted netmask as in
+// 10.0.0.0/255.0.0.0 or 10.0.0.0 255.0.0.0), a zone (*.example.com), the
+// subdomains of a domain (.example.com, which does not match example.com
+// itself) or a hostname (localhost). A trailing dot on a name is ignored.
+//
+// IP addresses may be written in square brackets ([::1]) or with
+// zero-padded IPv4 octets below 8 (127.000.000.001); other zero-padded
+// addresses, such as 010.0.0.1, are ambiguous between octal and decimal and
+// are ignored. An IPv6 address may carry a zone (fe80::1%eth0), in which
+// case only that zone matches.
+//
+// The value "*" causes every host to use the bypass proxy. Empty values are
+// skipped, so a string containing only commas and whitespace adds nothing. A
+// best effort is made to parse the string and errors are ignored.
 func (p *PerHost) AddFromString(s string) {
 	hosts := strings.Split(s, ",")
 	for _, host := range hosts {
@@ -86,14 +114,33 @@ func (p *PerHost) AddFromString(s string) {
 		if len(host) == 0 {
 			continue
 		}
-		if strings.Contains(host, "/") {
+		if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' {
+			host = host[1 : len(host)-1]
+		}
+		if host == "*" {
+			p.bypassAll = true
+			continue
+		}
+		if strings.ContainsAny(host, "/ \t") {
 			// We assume that it's a CIDR address like 127.0.0.0/8
-			if _, net, err := net.ParseCIDR(host); err == nil {
+			// or an address with a dotted netmask like
+			// 10.0.0.0 255.0.0.0.
+			if net, err := parseNetwork(host); err == nil {
 				p.AddNetwork(net)
 			}
 			continue
 		}
-		if ip := net.ParseIP(host); ip != nil {
+		if addr, zone := splitZone(host); zone != "" {
+			if ip, _ := parseIP(addr); ip != nil {
+				p.addZonedIP(ip, zone)
+				continue
+			}
+		}
+		ip, ambiguous := parseIP(host)
+		if ambiguous {
+			continue
+		}
+		if ip != nil {
 			p.AddIP(ip)
 			continue
 		}
@@ -101,17 +148,117 @@ func (p *PerHost) AddFromString(s string) {
 			p.AddZone(host[1:])
 			continue
 		}
+		if strings.HasPrefix(host, ".") {
+			p.addSubdomains(host)
+			continue
+		}
 		p.AddHost(host)
 	}
 }
 
+// parseHostIP parses a dialed host as an IP address. Unlike parseIP it is as
+// strict as net.ParseIP: the dialer may read a host such as 010.0.0.1 as
+// octal, so it must not be matched as a decimal address.
+func parseHostIP(s string) net.IP {
+	// Most hosts are names. Rejecting them by their characters avoids
+	// the cost of a failed net.ParseIP, which allocates an error.
+	if ok, _ := ipChars(s); !ok {
+		return nil
+	}
+	return net.ParseIP(s)
+}
+
+// ipChars reports whether s contains only characters that can appear in an
+// IP address literal, and whether those are all digits and dots.
+func ipChars(s string) (ok, digitsAndDots bool) {
+	digitsAndDots = true
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case '0' <= c && c <= '9', c == '.':
+		case 'a' <= c && c <= 'f', 'A' <= c && c <= 'F', c == ':':
+			digitsAndDots = false
+		default:
+			return false, false
+		}
+	}
+	return true, digitsAndDots
+}
+
+// parseIP parses a bypass entry as an IP address. It is like net.ParseIP but
+// also accepts zero-padded IPv4 octets whose octal and decimal readings agree,
+// as in 127.000.000.001. Other zero-padded octets, such as the 010 in
+// 010.0.0.1, may be read as either 8 or 10 by a dialer, so parseIP reports
+// such an entry as ambiguous rather than guessing.
+func parseIP(s string) (ip net.IP, ambiguous bool) {
+	ok, digitsAndDots := ipChars(s)
+	if !ok {
+		return nil, false
+	}
+	if ip := net.ParseIP(s); ip != nil || !digitsAndDots {
+		return ip, false
+	}
+	fields := strings.Split(s, ".")
+	if len(fields) != 4 {
+		return nil, false
+	}
+	var b [4]byte
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return nil, false
+		}
+		if len(f) > 1 && f[0] == '0' && n >= 8 {
+			return nil, true
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3]), false
+}
+
+// parseNetwork parses s as either a CIDR range (127.0.0.0/8) or an IPv4
+// address followed by a dotted netmask, separated by a slash or by
+// whitespace (10.0.0.0/255.0.0.0 or 10.0.0.0 255.0.0.0).
+func parseNetwork(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	i := strings.IndexAny(s, "/ \t")
+	if i < 0 {
+		return nil, errors.New("proxy: invalid network: " + s)
+	}
+	ip := net.ParseIP(s[:i]).To4()
+	mask := net.ParseIP(strings.TrimSpace(s[i+1:])).To4()
+	if ip == nil || mask == nil {
+		return nil, errors.New("proxy: invalid network: " + s)
+	}
+	m := net.IPMask(mask)
+	if _, bits := m.Size(); bits == 0 {
+		return nil, errors.New("proxy: non-contiguous netmask: " + s)
+	}
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}, nil
+}
+
 // AddIP specifies an IP address that will use the bypass proxy. Note that
 // this will only take effect if a literal IP address is dialed. A connection
-// to a named host will never match an IP.
+// to a named host will never match an IP. An IPv6 address matches whatever
+// zone the dialed address carries. An IPv4 address also matches its
+// IPv4-mapped IPv6 form, such as ::ffff:127.0.0.1.
 func (p *PerHost) AddIP(ip net.IP) {
 	p.bypassIPs = append(p.bypassIPs, ip)
 }
 
+// addZonedIP specifies an IPv6 address with a zone, such as fe80::1%eth0,
+// that will use the bypass proxy. Unlike AddIP, it only matches when the
+// dialed address carries the same zone. The address is compared in its
+// canonical form, but zones are compared exactly, since they name
+// interfaces and may be case-sensitive.
+func (p *PerHost) addZonedIP(ip net.IP, zone string) {
+	if p.bypassZonedIPs == nil {
+		p.bypassZonedIPs = make(map[string]bool)
+	}
+	p.bypassZonedIPs[ip.String()+"%"+zone] = true
+}
+
 // AddNetwork specifies an IP range that will use the bypass proxy. Note that
 // this will only take effect if a literal IP address is dialed. A connection
 // to a named host will never match.
@@ -120,21 +267,65 @@ func (p *PerHost) AddNetwork(net *net.IPNet) {
 }
 
 // AddZone specifies a DNS suffix that will use the bypass proxy. A zone of
-// "example.com" matches "example.com" and all of its subdomains.
+// "example.com" matches "example.com" and all of its subdomains. A leading
+// dot is ignored here, so ".example.com" also matches "example.com", unlike
+// the ".example.com" form in AddFromString, which matches only subdomains.
+// Matching ignores case, and internationalized names match their punycode
+// form, so a zone of "münchen.example" also matches "a.XN--MNCHEN-3YA.example".
 func (p *PerHost) AddZone(zone string) {
-	if strings.HasSuffix(zone, ".") {
-		zone = zone[:len(zone)-1]
-	}
+	zone = normalizeHost(zone)
 	if !strings.HasPrefix(zone, ".") {
 		zone = "." + zone
 	}
-	p.bypassZones = append(p.bypassZones, zone)
+	if p.bypassZones == nil {
+		p.bypassZones = make(map[string]bool)
+	}
+	p.bypassZones[zone] = true
+}
+
+// addSubdomains specifies a DNS suffix whose subdomains, but not the domain
+// itself, will use the bypass proxy. A domain of ".example.com" matches
+// "a.example.com" but not "example.com".
+func (p *PerHost) addSubdomains(domain string) {
+	domain = normalizeHost(domain)
+	if !strings.HasPrefix(domain, ".") {
+		domain = "." + domain
+	}
+	if p.bypassSubdomains == nil {
+		p.bypassSubdomains = make(map[string]bool)
+	}
+	p.bypassSubdomains[domain] = true
 }
 
-// AddHost specifies a hostname that will use the bypass proxy.
+// AddHost specifies a hostname that will use the bypass proxy. Only that
+// exact host matches; use AddZone to include its subdomains.
 func (p *PerHost) AddHost(host string) {
-	if strings.HasSuffix(host, ".") {
-		host = host[:len(host)-1]
+	host = normalizeHost(host)
+	if p.bypassHosts == nil {
+		p.bypassHosts = make(map[string]bool)
+	}
+	p.bypassHosts[host] = true
+}
+
+// splitZone splits an IPv6 zone identifier, as in fe80::1%eth0, from host.
+func splitZone(host string) (addr, zone string) {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// normalizeHost returns the form of the host name used for matching: without
+// a trailing dot, lower-cased and converted to ASCII (punycode). Lower-casing
+// comes before the IDNA conversion so that differently cased Unicode names
+// encode to the same punycode. If the conversion fails, the lower-cased name
+// is returned. IPv6 zones are handled separately by splitZone, since a zone
+// is significant when matching zoned IP entries.
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	host = strings.ToLower(host)
+	if a, err := idna.ToASCII(host); err == nil {
+		return a
 	}
-	p.bypassHosts = append(p.bypassHosts, host)
+	return host
 }
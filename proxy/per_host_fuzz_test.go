@@ -0,0 +1,41 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package proxy
+
+import "testing"
+
+func FuzzPerHost(f *testing.F) {
+	for _, seed := range []struct{ noProxy, host string }{
+		{"localhost,*.zone,127.0.0.1,10.0.0.1/8,1000::/16", "foo.zone"},
+		{"10.0.0.0 255.0.0.0,192.168.1.0/255.255.255.0", "10.0.0.1"},
+		{"fe80::1,fe80::2%eth0", "fe80::2%eth0"},
+		{"*.münchen.example,CAFÉ.EXAMPLE", "a.xn--mnchen-3ya.example"},
+		{"*", "example.com"},
+		{" , ,\t", "example.com"},
+		{"0.0.1", "10.0.0.1"},
+		{":1", "::1"},
+		{"*.", "."},
+	} {
+		f.Add(seed.noProxy, seed.host)
+	}
+	f.Fuzz(func(t *testing.T, noProxy, host string) {
+		var def, bypass recordingProxy
+		perHost := NewPerHost(&def, &bypass)
+		perHost.AddFromString(noProxy)
+		again := NewPerHost(&def, &bypass)
+		again.AddFromString(noProxy)
+
+		d := perHost.dialerForRequest(host)
+		if d != &def && d != &bypass {
+			t.Fatalf("AddFromString(%q): %q matched neither dialer", noProxy, host)
+		}
+		if perHost.dialerForRequest(host) != d || again.dialerForRequest(host) != d {
+			t.Fatalf("AddFromString(%q): inconsistent result for %q", noProxy, host)
+		}
+	})
+}
@@ -6,8 +6,10 @@ package proxy
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,3 +55,216 @@ func TestPerHost(t *testing.T) {
 		t.Errorf("Hosts which went to the bypass proxy didn't match. Got %v, want %v", bypass.addrs, expectedBypass)
 	}
 }
+
+func BenchmarkPerHostLargeList(b *testing.B) {
+	var entries []string
+	for i := 0; i < 5000; i++ {
+		entries = append(entries, fmt.Sprintf("host%d.example.com", i), fmt.Sprintf("*.zone%d.example.net", i))
+	}
+	perHost := NewPerHost(Direct, Direct)
+	perHost.AddFromString(strings.Join(entries, ","))
+	hosts := []string{
+		"host4999.example.com",
+		"a.b.zone4999.example.net",
+		"unlisted.example.org",
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, host := range hosts {
+			perHost.dialerForRequest(host)
+		}
+	}
+}
+
+func TestPerHostSpecialValues(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		bypass  bool
+	}{
+		{"", false},
+		{",", false},
+		{" , ,\t", false},
+		{"   ", false},
+		{"*", true},
+		{" * ", true},
+		{"example.com,*", true},
+	}
+	for _, test := range tests {
+		var def, bypass recordingProxy
+		perHost := NewPerHost(&def, &bypass)
+		perHost.AddFromString(test.noProxy)
+		perHost.Dial("tcp", "example.org:80")
+		perHost.Dial("tcp", "10.0.0.1:80")
+		wantDef, wantBypass := 2, 0
+		if test.bypass {
+			wantDef, wantBypass = 0, 2
+		}
+		if len(def.addrs) != wantDef || len(bypass.addrs) != wantBypass {
+			t.Errorf("AddFromString(%q): got default %v, bypass %v", test.noProxy, def.addrs, bypass.addrs)
+		}
+	}
+}
+
+func TestPerHostMatching(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		host    string
+		bypass  bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.2", false},
+		{"0.0.1", "10.0.0.1", false},
+		{".0.0.1", "10.0.0.1", false},
+		{"*.0.0.1", "10.0.0.1", false},
+		{"0.0.1", "0.0.1", true},
+		{"::1", "::1", true},
+		{"::1", "0:0::1", true},
+		{"::1", "::2", false},
+		{"1::1", "::1", false},
+		{"10.0.0.0/8", "10.200.0.1", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"10.0.0.0/8", "10.example.com", false},
+		{"127.0.0.1", "::ffff:127.0.0.1", true},
+		{"10.0.0.1/8", "::ffff:10.1.2.3", true},
+		{"127.0.0.0/8", "::ffff:127.0.0.5", true},
+		{"127.0.0.0/8", "::ffff:128.0.0.5", false},
+		{"127.0.0.1", "::ffff:127.0.0.5", false},
+		{"::ffff:127.0.0.0/104", "127.0.0.5", true},
+		{"127.0.0.1", "localhost", false},
+
+		// Networks with dotted netmasks.
+		{"10.0.0.0 255.0.0.0", "10.0.0.1", true},
+		{"10.0.0.0 255.0.0.0", "10.255.255.255", true},
+		{"10.0.0.0 255.0.0.0", "11.0.0.1", false},
+		{"192.168.1.0/255.255.255.0", "192.168.1.7", true},
+		{"192.168.1.0/255.255.255.0", "192.168.2.1", false},
+		{"172.16.0.0 255.0.255.0", "172.16.0.1", false},
+
+		// Other spellings of IP entries.
+		{"127.000.000.001", "127.0.0.1", true},
+		{"[0:0:0:0:0:0:0:1]", "::1", true},
+		{"010.0.0.1", "10.0.0.1", false},
+		{"010.0.0.1", "8.0.0.1", false},
+		{"010.0.0.1", "010.0.0.1", false},
+		{"10.0.0.0/8", "010.0.0.1", false},
+		{"127.0.0.1", "127.000.000.001", false},
+		{"127.000.000.007", "127.0.0.7", true},
+		{"127.000.000.008", "127.0.0.8", false},
+		{"127.000.000.008", "127.000.000.008", false},
+		{"0255.0.0.1", "255.0.0.1", false},
+		{"1.2.3.0256", "1.2.3.0", false},
+
+		// IPv6 zones.
+		{"fe80::1", "fe80::1", true},
+		{"fe80::1", "fe80::1%eth0", true},
+		{"fe80::2%eth0", "fe80::2%eth0", true},
+		{"fe80::2%eth0", "fe80:0::2%eth0", true},
+		{"fe80::2%eth0", "fe80::2", false},
+		{"fe80::2%eth0", "fe80::2%eth1", false},
+		{"fe80::2%eth0", "fe80::3%eth0", false},
+		{"[FE80::1%eth0]", "fe80::1%eth0", true},
+		{"[FE80::1%eth0]", "fe80::1%eth1", false},
+		{"FE80::ABCD%Eth0", "fe80::abcd%Eth0", true},
+		{"FE80::ABCD%Eth0", "FE80:0:0::AbCd%Eth0", true},
+		{"FE80::ABCD%Eth0", "fe80::abcd%eth0", false},
+		{"FE80::ABCD%Eth0", "fe80::abcd%ETH0", false},
+		{"2001:DB8::1", "2001:db8::1", true},
+		{"2001:DB8::1", "2001:0DB8::0001%Eth0", true},
+
+		// Hosts match exactly; zones include subdomains.
+		{"example.com", "example.com", true},
+		{"example.com", "app.example.com", false},
+		{"example.com", "ample.com", false},
+		{"*.example.org", "example.org", true},
+		{"*.example.org", "app.example.org", true},
+		{"*.example.org", "xexample.org", false},
+
+		// Leading and trailing dots.
+		{".zone1.example.", "zone1.example", false},
+		{".zone1.example.", "a.zone1.example", true},
+		{".zone1.example.", "a.zone1.example.", true},
+		{".zone1.example.", "xzone1.example", false},
+		{".zone1.example.", "example", false},
+		{"zone2.example.", "zone2.example", true},
+		{"zone2.example.", "zone2.example.", true},
+		{"zone2.example.", "a.zone2.example", false},
+		{".zone3.example", "zone3.example", false},
+		{".zone3.example", "zone3.example.", false},
+		{".zone3.example", "a.b.zone3.example", true},
+		{"*.zone4.example.", "zone4.example", true},
+		{"*.zone4.example.", "a.zone4.example.", true},
+
+		// Internationalized names.
+		{"*.münchen.example", "a.xn--mnchen-3ya.example", true},
+		{"*.münchen.example", "b.a.münchen.example", true},
+		{"*.münchen.example", "xn--mnchen-3ya.example", true},
+		{"*.münchen.example", "a.munchen.example", false},
+		{"bücher.example", "bücher.example", true},
+		{"bücher.example", "xn--bcher-kva.example", true},
+		{"bücher.example", "a.bücher.example", false},
+		{"*.xn--caf-dma.example", "a.café.example", true},
+
+		// Case.
+		{"CAFÉ.EXAMPLE", "café.example", true},
+		{"CAFÉ.EXAMPLE", "Café.Example", true},
+		{"CAFÉ.EXAMPLE", "CAFÉ.EXAMPLE", true},
+		{"CAFÉ.EXAMPLE", "XN--CAF-DMA.example", true},
+		{"CAFÉ.EXAMPLE", "cafe.example", false},
+		{"*.Zone.Example", "a.ZONE.example", true},
+		{"*.Zone.Example", "zone.example.com", false},
+		{"LocalHost", "localhost", true},
+		{"LocalHost", "LOCALHOST", true},
+	}
+	for _, test := range tests {
+		var def, bypass recordingProxy
+		perHost := NewPerHost(&def, &bypass)
+		perHost.AddFromString(test.noProxy)
+		got := perHost.dialerForRequest(test.host) == &bypass
+		if got != test.bypass {
+			t.Errorf("AddFromString(%q): bypass for %q got %v, want %v", test.noProxy, test.host, got, test.bypass)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com.", "example.com"},
+		{"EXAMPLE.COM", "example.com"},
+		{"Example.Com.", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example", "xn--bcher-kva.example"},
+		{"BÜCHER.EXAMPLE.", "xn--bcher-kva.example"},
+		{"XN--BCHER-KVA.example.", "xn--bcher-kva.example"},
+		{".münchen.example", ".xn--mnchen-3ya.example"},
+		{"", ""},
+		{".", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeHost(test.host); got != test.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func BenchmarkPerHostASCII(b *testing.B) {
+	perHost := NewPerHost(Direct, Direct)
+	perHost.AddFromString("localhost,*.corp.example.com,10.0.0.0/8,internal.example.net")
+	hosts := []string{
+		"www.example.com",
+		"api.corp.example.com",
+		"internal.example.net",
+		"a.b.c.d.example.org",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, host := range hosts {
+			perHost.dialerForRequest(host)
+		}
+	}
+}
@@ -8,6 +8,7 @@ package proxy // import "golang.org/x/net/proxy"
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
@@ -25,7 +26,12 @@ type Auth struct {
 }
 
 // FromEnvironment returns the dialer specified by the proxy related variables in
-// the environment.
+// the environment. The proxy is taken from all_proxy. Hosts that bypass it are
+// taken from the first of no_proxy, NO_PROXY, NOPROXY and no-proxy that is set
+// to a non-empty value. The lower-case no_proxy comes first because it is the
+// spelling FromEnvironment has always read; if several spellings are set to
+// different values, the others are ignored. FromEnvironmentVerbose reports
+// such conflicts.
 func FromEnvironment() Dialer {
 	allProxy := os.Getenv("all_proxy")
 	if len(allProxy) == 0 {
@@ -41,7 +47,7 @@ func FromEnvironment() Dialer {
 		return Direct
 	}
 
-	noProxy := os.Getenv("no_proxy")
+	noProxy := getEnvAny(noProxyEnv...)
 	if len(noProxy) == 0 {
 		return proxy
 	}
@@ -51,6 +57,51 @@ func FromEnvironment() Dialer {
 	return perHost
 }
 
+// FromEnvironmentVerbose is like FromEnvironment but also returns a warning for
+// each no_proxy spelling that is ignored because a spelling with higher
+// precedence is set to a different value, so that conflicting configuration
+// can be detected.
+func FromEnvironmentVerbose() (Dialer, []string) {
+	return FromEnvironment(), envConflicts(noProxyEnv...)
+}
+
+// noProxyEnv lists the spellings of the no_proxy variable understood by
+// FromEnvironment, in order of precedence.
+var noProxyEnv = []string{"no_proxy", "NO_PROXY", "NOPROXY", "no-proxy"}
+
+// getEnvAny returns the value of the first of the named environment
+// variables that is set to a non-empty value.
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if val := os.Getenv(n); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// envConflicts returns a warning for each of the named environment variables
+// that is set to a non-empty value different from the one getEnvAny would
+// return for the same names.
+func envConflicts(names ...string) []string {
+	var warnings []string
+	var used, usedVal string
+	for _, n := range names {
+		val := os.Getenv(n)
+		if val == "" {
+			continue
+		}
+		if used == "" {
+			used, usedVal = n, val
+			continue
+		}
+		if val != usedVal {
+			warnings = append(warnings, fmt.Sprintf("proxy: ignoring %s=%q, which conflicts with %s=%q", n, val, used, usedVal))
+		}
+	}
+	return warnings
+}
+
 // proxySchemes is a map from URL schemes to a function that creates a Dialer
 // from a URL with such a scheme.
 var proxySchemes map[string]func(*url.URL, Dialer) (Dialer, error)
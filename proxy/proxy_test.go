@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"os"
 	"strconv"
 	"sync"
 	"testing"
@@ -50,6 +51,110 @@ func TestFromURL(t *testing.T) {
 	wg.Wait()
 }
 
+func TestFromURLPreservesHostCase(t *testing.T) {
+	u, err := url.Parse("socks5://Proxy.Example.COM:1080")
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	proxy, err := FromURL(u, Direct)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	if addr := proxy.(*socks5).addr; addr != "Proxy.Example.COM:1080" {
+		t.Errorf("got proxy address %q, want %q", addr, "Proxy.Example.COM:1080")
+	}
+}
+
+func TestFromEnvironmentNoProxySpellings(t *testing.T) {
+	// In order of precedence.
+	spellings := []string{"no_proxy", "NO_PROXY", "NOPROXY", "no-proxy"}
+	for _, name := range append([]string{"all_proxy"}, spellings...) {
+		if val, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, val)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	os.Setenv("all_proxy", "socks5://127.0.0.1:1080")
+	reset := func() {
+		for _, name := range spellings {
+			os.Unsetenv(name)
+		}
+	}
+
+	for _, name := range spellings {
+		reset()
+		os.Setenv(name, "example.com")
+
+		perHost, ok := FromEnvironment().(*PerHost)
+		if !ok {
+			t.Errorf("%s: FromEnvironment did not return a *PerHost", name)
+			continue
+		}
+		if perHost.dialerForRequest("example.com") != Direct {
+			t.Errorf("%s: example.com was not bypassed", name)
+		}
+		if perHost.dialerForRequest("example.org") == Direct {
+			t.Errorf("%s: example.org was bypassed", name)
+		}
+	}
+
+	for i, first := range spellings {
+		for _, second := range spellings[i+1:] {
+			reset()
+			os.Setenv(first, "example.com")
+			os.Setenv(second, "example.org")
+
+			perHost, ok := FromEnvironment().(*PerHost)
+			if !ok {
+				t.Errorf("%s, %s: FromEnvironment did not return a *PerHost", first, second)
+				continue
+			}
+			if perHost.dialerForRequest("example.org") == Direct {
+				t.Errorf("%s was used in preference to %s", second, first)
+			}
+		}
+	}
+}
+
+func TestFromEnvironmentVerbose(t *testing.T) {
+	for _, name := range append([]string{"all_proxy"}, noProxyEnv...) {
+		if val, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, val)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+	os.Setenv("all_proxy", "socks5://127.0.0.1:1080")
+
+	tests := []struct {
+		env      map[string]string
+		warnings int
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{"no_proxy": "example.com"}, 0},
+		{map[string]string{"no_proxy": "example.com", "NO_PROXY": "example.com"}, 0},
+		{map[string]string{"no_proxy": "example.com", "NO_PROXY": "example.org"}, 1},
+		{map[string]string{"NO_PROXY": "example.com", "NOPROXY": "example.org", "no-proxy": "example.net"}, 2},
+	}
+	for _, test := range tests {
+		for _, name := range noProxyEnv {
+			os.Unsetenv(name)
+		}
+		for name, val := range test.env {
+			os.Setenv(name, val)
+		}
+		d, warnings := FromEnvironmentVerbose()
+		if d == nil {
+			t.Errorf("%v: FromEnvironmentVerbose returned a nil Dialer", test.env)
+		}
+		if len(warnings) != test.warnings {
+			t.Errorf("%v: got warnings %q, want %d", test.env, warnings, test.warnings)
+		}
+	}
+}
+
 func TestSOCKS5(t *testing.T) {
 	endSystem, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {